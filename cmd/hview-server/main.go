@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -44,7 +45,12 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
-		du.SetLogLevelString(config.LogLevel)
+		if len(config.LogConfig.Level) == 0 && len(config.LogLevel) > 0 {
+			// LogLevel drove the old ad-hoc logger directly; the structured
+			// zap logger reads LogConfig.Level instead, so fall back to it
+			// for existing configs that only set the old field.
+			config.LogConfig.Level = config.LogLevel
+		}
 		myaddr, ok := config.Peers[config.Id]
 		if !ok {
 			panic("Id is not present in peers")
@@ -89,26 +95,32 @@ func main() {
 
 	gs := service.NewHealthGServer(config)
 	errch := make(chan error)
+	ctx, cancel := context.WithCancel(context.Background())
 
-	if len(*cpuprofile) > 0 {
+	profiling := len(*cpuprofile) > 0
+	if profiling {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
 			fmt.Errorf("Failed to create profile\n")
 		}
 		pprof.StartCPUProfile(f)
-		sigs := make(chan os.Signal, 1)
-		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
-		go func() {
-			sig := <-sigs
-			fmt.Printf("got signal %v, clean up before shutdown...\n", sig)
-			gs.Stop(true)
-			pprof.StopCPUProfile()
-			os.Exit(0)
-		}()
 	}
 
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		fmt.Printf("got signal %v, clean up before shutdown...\n", sig)
+		cancel()
+		gs.Stop(true)
+		if profiling {
+			pprof.StopCPUProfile()
+		}
+		os.Exit(0)
+	}()
+
 	fmt.Printf("Starting health service at %s with config %v\n", config.Addr, config)
-	gs.Start(errch)
+	gs.Start(ctx, errch)
 	<-errch
 	fmt.Println("Encountered error, exit.")
 	os.Exit(1)
@@ -0,0 +1,173 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+
+	capi "github.com/hashicorp/consul/api"
+)
+
+// consulDiscoverer implements Discoverer on top of Consul's catalog and
+// health-check APIs. Membership changes are detected by long-polling the
+// health checks for cfg.Service with Consul's blocking query support.
+type consulDiscoverer struct {
+	cfg    Config
+	client *capi.Client
+	selfId string
+
+	mu    sync.Mutex
+	peers map[string]string
+
+	// watching is set once watchLoop has been started by Register, so Close
+	// knows whether to wait on done (a Close with no prior, or a failed,
+	// Register must not block forever on a loop that never runs).
+	watching bool
+
+	events chan PeerEvent
+	done   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newConsulDiscoverer(cfg Config) (Discoverer, error) {
+	ccfg := capi.DefaultConfig()
+	ccfg.Address = cfg.Address
+	client, err := capi.NewClient(ccfg)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &consulDiscoverer{
+		cfg:    cfg,
+		client: client,
+		peers:  make(map[string]string),
+		events: make(chan PeerEvent, 16),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+func (d *consulDiscoverer) Register(id, addr string) error {
+	d.selfId = id
+	reg := &capi.AgentServiceRegistration{
+		ID:      id,
+		Name:    d.cfg.Service,
+		Address: addr,
+		Tags:    d.cfg.Tags,
+	}
+	// A GRPC check against addr would never pass: nothing in this series
+	// registers grpc.health.v1.Health on HealthGServer's server. Use the
+	// metrics listener's /healthz instead, if one is configured; with no
+	// check at all Consul treats the service as always passing.
+	if len(d.cfg.HealthCheckURL) > 0 {
+		reg.Check = &capi.AgentServiceCheck{
+			HTTP:                           d.cfg.HealthCheckURL,
+			Interval:                       "10s",
+			DeregisterCriticalServiceAfter: "1m",
+		}
+	}
+	if err := d.client.Agent().ServiceRegister(reg); err != nil {
+		return err
+	}
+	d.watching = true
+	go d.watchLoop()
+	return nil
+}
+
+// watchLoop long-polls Consul for membership changes until ctx is
+// canceled, closing events (so Watch's range loop terminates instead of
+// blocking callers such as HealthGServer.watchPeers forever) and done (so
+// Close can wait for the loop to actually exit without racing a real event
+// arriving on events at the same moment).
+func (d *consulDiscoverer) watchLoop() {
+	defer close(d.done)
+	defer close(d.events)
+	var lastIndex uint64
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		default:
+		}
+		entries, meta, err := d.client.Health().Service(d.cfg.Service, "", true, (&capi.QueryOptions{
+			WaitIndex: lastIndex,
+		}).WithContext(d.ctx))
+		if err != nil {
+			if d.ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		lastIndex = meta.LastIndex
+		seen := make(map[string]string, len(entries))
+		for _, entry := range entries {
+			id := entry.Service.ID
+			if id == d.selfId {
+				continue
+			}
+			seen[id] = entry.Service.Address
+		}
+		d.reconcile(seen)
+	}
+}
+
+// reconcile updates d.peers under mu, then emits the resulting events after
+// releasing it. Each send is guarded by a select on d.ctx.Done(), so a slow
+// or stopped consumer (e.g. watchPeers already having exited on ctx
+// cancellation) cannot wedge this goroutine on a full, permanently unread
+// events channel forever — which would otherwise also keep it from ever
+// reaching close(d.done), hanging Close().
+func (d *consulDiscoverer) reconcile(seen map[string]string) {
+	d.mu.Lock()
+	var events []PeerEvent
+	for id, addr := range seen {
+		if _, ok := d.peers[id]; !ok {
+			d.peers[id] = addr
+			events = append(events, PeerEvent{Type: PeerAdded, Id: id, Addr: addr})
+		}
+	}
+	for id, addr := range d.peers {
+		if _, ok := seen[id]; !ok {
+			delete(d.peers, id)
+			events = append(events, PeerEvent{Type: PeerRemoved, Id: id, Addr: addr})
+		}
+	}
+	d.mu.Unlock()
+
+	for _, ev := range events {
+		select {
+		case d.events <- ev:
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *consulDiscoverer) Watch() <-chan PeerEvent {
+	return d.events
+}
+
+func (d *consulDiscoverer) List() map[string]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make(map[string]string, len(d.peers))
+	for id, addr := range d.peers {
+		out[id] = addr
+	}
+	return out
+}
+
+// Close stops watchLoop (unblocking any in-flight blocking query) and
+// waits for it to exit and close events before returning, so callers
+// ranging over Watch() are guaranteed to see it terminate.
+func (d *consulDiscoverer) Close() error {
+	d.cancel()
+	if d.watching {
+		<-d.done
+	}
+	if len(d.selfId) > 0 {
+		return d.client.Agent().ServiceDeregister(d.selfId)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Package discovery lets HealthGServer learn its peer set from a service
+// registry instead of the static map in HealthServerConfig, so a deployment
+// can autoscale without every instance being re-configured and restarted.
+package discovery
+
+import "fmt"
+
+// EventType describes how a peer in a PeerEvent changed.
+type EventType int
+
+const (
+	PeerAdded EventType = iota
+	PeerRemoved
+)
+
+// PeerEvent is delivered on the channel returned by Discoverer.Watch
+// whenever a peer joins or leaves the registered service.
+type PeerEvent struct {
+	Type EventType
+	Id   string
+	Addr string
+}
+
+// Config selects and configures a Discoverer. It is loaded from the
+// HealthServerConfig.Discovery block.
+type Config struct {
+	// Type is "consul" or "etcd". An empty Type disables discovery.
+	Type string `json:"type"`
+	// Address is the registry endpoint, e.g. "127.0.0.1:8500" for Consul or
+	// "127.0.0.1:2379" for etcd.
+	Address string `json:"address"`
+	// Service is the name this panorama deployment registers under.
+	Service string `json:"service"`
+	// Tags are attached to this instance's registration.
+	Tags []string `json:"tags"`
+	// HealthCheckURL, if set, is polled by the Consul backend as an HTTP
+	// health check (e.g. "http://host:metricsPort/healthz", served by
+	// metrics.Collector.Start) to decide whether this instance is passing.
+	// Unused by the etcd backend. Left empty, Consul registers no check at
+	// all, so the instance is always considered healthy.
+	HealthCheckURL string `json:"health_check_url"`
+}
+
+// Discoverer registers this instance with a service registry and watches
+// it for membership changes among peers offering the same service.
+type Discoverer interface {
+	// Register advertises id/addr under the configured service name.
+	Register(id, addr string) error
+	// Watch returns a channel of membership changes. It is closed when the
+	// Discoverer is closed.
+	Watch() <-chan PeerEvent
+	// List returns the currently known peer id -> addr map.
+	List() map[string]string
+	// Close deregisters this instance and stops Watch.
+	Close() error
+}
+
+// New builds the Discoverer selected by cfg.Type.
+func New(cfg Config) (Discoverer, error) {
+	switch cfg.Type {
+	case "consul":
+		return newConsulDiscoverer(cfg)
+	case "etcd":
+		return newEtcdDiscoverer(cfg)
+	default:
+		return nil, fmt.Errorf("discovery: unknown backend %q", cfg.Type)
+	}
+}
@@ -0,0 +1,172 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/clientv3"
+)
+
+const etcdLeaseTTLSeconds = 15
+
+// etcdDiscoverer implements Discoverer with etcd's key prefix watch: each
+// instance writes its id/addr under servicePrefix(cfg.Service)+id, attached
+// to a lease it keeps alive, so a crashed instance disappears once its
+// lease expires.
+type etcdDiscoverer struct {
+	cfg    Config
+	client *clientv3.Client
+	selfId string
+	lease  clientv3.LeaseID
+
+	mu    sync.Mutex
+	peers map[string]string
+
+	// watching is set once watchLoop has been started by Register, so Close
+	// only waits on done when the loop actually runs.
+	watching bool
+
+	events chan PeerEvent
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+func newEtcdDiscoverer(cfg Config) (Discoverer, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{cfg.Address},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdDiscoverer{
+		cfg:    cfg,
+		client: client,
+		peers:  make(map[string]string),
+		events: make(chan PeerEvent, 16),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+func (d *etcdDiscoverer) servicePrefix() string {
+	return fmt.Sprintf("/panorama/discovery/%s/", d.cfg.Service)
+}
+
+func (d *etcdDiscoverer) Register(id, addr string) error {
+	d.selfId = id
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+
+	lease, err := d.client.Grant(ctx, etcdLeaseTTLSeconds)
+	if err != nil {
+		return err
+	}
+	d.lease = lease.ID
+	if _, err := d.client.Put(ctx, d.servicePrefix()+id, addr, clientv3.WithLease(d.lease)); err != nil {
+		return err
+	}
+	keepAlive, err := d.client.KeepAlive(ctx, d.lease)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for range keepAlive {
+		}
+	}()
+
+	if err := d.loadExisting(ctx); err != nil {
+		return err
+	}
+	d.watching = true
+	go d.watchLoop(ctx)
+	return nil
+}
+
+func (d *etcdDiscoverer) loadExisting(ctx context.Context) error {
+	resp, err := d.client.Get(ctx, d.servicePrefix(), clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, kv := range resp.Kvs {
+		id := string(kv.Key[len(d.servicePrefix()):])
+		if id == d.selfId {
+			continue
+		}
+		d.peers[id] = string(kv.Value)
+	}
+	return nil
+}
+
+// watchLoop ranges over etcd's watch channel until ctx is canceled, at
+// which point etcd closes watch and this closes events and done in turn,
+// so Watch's range loop and Close's wait both terminate instead of
+// blocking forever (see the Consul implementation for the same pattern).
+func (d *etcdDiscoverer) watchLoop(ctx context.Context) {
+	defer close(d.done)
+	defer close(d.events)
+	watch := d.client.Watch(ctx, d.servicePrefix(), clientv3.WithPrefix())
+	for resp := range watch {
+		for _, ev := range resp.Events {
+			id := string(ev.Kv.Key[len(d.servicePrefix()):])
+			if id == d.selfId {
+				continue
+			}
+			d.mu.Lock()
+			var out *PeerEvent
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				addr := string(ev.Kv.Value)
+				d.peers[id] = addr
+				out = &PeerEvent{Type: PeerAdded, Id: id, Addr: addr}
+			case clientv3.EventTypeDelete:
+				addr := d.peers[id]
+				delete(d.peers, id)
+				out = &PeerEvent{Type: PeerRemoved, Id: id, Addr: addr}
+			}
+			d.mu.Unlock()
+			if out == nil {
+				continue
+			}
+			// Guarded by ctx.Done(), not an unconditional send: a slow or
+			// already-exited consumer must not wedge this goroutine on a
+			// full events channel forever, which would also keep it from
+			// ever reaching close(d.done) and hang Close().
+			select {
+			case d.events <- *out:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (d *etcdDiscoverer) Watch() <-chan PeerEvent {
+	return d.events
+}
+
+func (d *etcdDiscoverer) List() map[string]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make(map[string]string, len(d.peers))
+	for id, addr := range d.peers {
+		out[id] = addr
+	}
+	return out
+}
+
+func (d *etcdDiscoverer) Close() error {
+	if d.cancel != nil {
+		d.cancel()
+	}
+	if d.watching {
+		<-d.done
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := d.client.Revoke(ctx, d.lease)
+	return err
+}
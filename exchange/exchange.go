@@ -0,0 +1,167 @@
+// Package exchange implements the peer-to-peer propagation protocol
+// HealthGServer uses to share reports and subscriptions with the rest of
+// the panorama cluster. Every outbound RPC is routed through an
+// exchange/lb.LoadBalancer, so a single dead or slow peer cannot stall a
+// propagation goroutine or hold up a ping sweep.
+package exchange
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc"
+
+	pb "panorama/build/gen"
+	"panorama/exchange/lb"
+	dt "panorama/types"
+)
+
+// ExchangeProtocol implements dt.HealthExchange.
+type ExchangeProtocol struct {
+	selfId string
+	lb     *lb.LoadBalancer
+
+	mu        sync.Mutex
+	peers     map[string]string          // peer id -> addr
+	interests map[string]map[string]bool // subject -> set of interested peer ids
+}
+
+// NewExchangeProtocol builds an ExchangeProtocol for config.Id, dialing
+// every statically configured peer in config.Peers through balancer.
+func NewExchangeProtocol(config *dt.HealthServerConfig, balancer *lb.LoadBalancer) *ExchangeProtocol {
+	e := &ExchangeProtocol{
+		selfId:    config.Id,
+		lb:        balancer,
+		peers:     make(map[string]string),
+		interests: make(map[string]map[string]bool),
+	}
+	for id, addr := range config.Peers {
+		e.AddPeer(id, addr)
+	}
+	return e
+}
+
+// AddPeer registers a newly discovered (or statically configured) peer.
+func (e *ExchangeProtocol) AddPeer(id, addr string) {
+	e.mu.Lock()
+	e.peers[id] = addr
+	e.mu.Unlock()
+	e.lb.SetPeer(id, []string{addr})
+}
+
+// RemovePeer drops a peer that left the cluster.
+func (e *ExchangeProtocol) RemovePeer(id string) {
+	e.mu.Lock()
+	delete(e.peers, id)
+	for _, interested := range e.interests {
+		delete(interested, id)
+	}
+	e.mu.Unlock()
+	e.lb.RemovePeer(id)
+}
+
+// Interested records that peerId wants future reports for subject.
+func (e *ExchangeProtocol) Interested(peerId, subject string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	interested, ok := e.interests[subject]
+	if !ok {
+		interested = make(map[string]bool)
+		e.interests[subject] = interested
+	}
+	interested[peerId] = true
+}
+
+// Uninterested removes peerId from subject's interested set.
+func (e *ExchangeProtocol) Uninterested(peerId, subject string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if interested, ok := e.interests[subject]; ok {
+		delete(interested, peerId)
+	}
+}
+
+func (e *ExchangeProtocol) peerIds() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ids := make([]string, 0, len(e.peers))
+	for id := range e.peers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Propagate sends report to every peer that has previously told us, via a
+// SUBSCRIPTION LearnReport, that it's interested in the report's subject.
+func (e *ExchangeProtocol) Propagate(ctx context.Context, report *pb.Report) {
+	e.mu.Lock()
+	interested := e.interests[report.Subject]
+	targets := make([]string, 0, len(interested))
+	for id := range interested {
+		targets = append(targets, id)
+	}
+	e.mu.Unlock()
+	for _, id := range targets {
+		e.learn(ctx, id, pb.LearnReportRequest_NORMAL, report)
+	}
+}
+
+// Subscribe tells every known peer we'd like to receive future reports for
+// subject.
+func (e *ExchangeProtocol) Subscribe(ctx context.Context, subject string) {
+	for _, id := range e.peerIds() {
+		e.learn(ctx, id, pb.LearnReportRequest_SUBSCRIPTION, &pb.Report{Subject: subject})
+	}
+}
+
+// Unsubscribe tells every known peer to stop sending us reports for subject.
+func (e *ExchangeProtocol) Unsubscribe(ctx context.Context, subject string) {
+	for _, id := range e.peerIds() {
+		e.learn(ctx, id, pb.LearnReportRequest_UNSUBSCRIPTION, &pb.Report{Subject: subject})
+	}
+}
+
+func (e *ExchangeProtocol) learn(ctx context.Context, id string, kind pb.LearnReportRequest_Kind, report *pb.Report) error {
+	req := &pb.LearnReportRequest{
+		Kind:   kind,
+		Report: report,
+		Source: &pb.Peer{Id: e.selfId},
+	}
+	return e.lb.Call(ctx, id, func(conn *grpc.ClientConn) error {
+		_, err := pb.NewHealthServiceClient(conn).LearnReport(ctx, req)
+		return err
+	})
+}
+
+// PingAll pings every known peer through the load balancer (so a peer whose
+// circuit breaker is open is skipped rather than blocking the sweep) and
+// returns the round-trip time of each successful ping.
+func (e *ExchangeProtocol) PingAll(ctx context.Context) map[string]time.Duration {
+	ids := e.peerIds()
+	rtts := make(map[string]time.Duration)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		id := id
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := e.lb.Call(ctx, id, func(conn *grpc.ClientConn) error {
+				req := &pb.PingRequest{Source: &pb.Peer{Id: e.selfId}, Time: ptypes.TimestampNow()}
+				_, err := pb.NewHealthServiceClient(conn).Ping(ctx, req)
+				return err
+			})
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			rtts[id] = time.Since(start)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return rtts
+}
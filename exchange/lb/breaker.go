@@ -0,0 +1,138 @@
+package lb
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the circuit breaker's current state.
+type State int
+
+const (
+	// Closed: requests pass through normally; failures are counted.
+	Closed State = iota
+	// Open: requests are rejected immediately without being attempted.
+	Open
+	// HalfOpen: a single trial request is allowed through to test recovery.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Breaker is a per-peer circuit breaker. It opens after Threshold
+// consecutive failures and half-opens after Cooldown to test whether the
+// peer has recovered, closing again on the first success.
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	// OnStateChange, if set, is invoked whenever the breaker transitions,
+	// so callers can log it and update a Prometheus gauge.
+	OnStateChange func(from, to State)
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	// trialInFlight gates HalfOpen so only the first caller after Cooldown
+	// gets to probe the peer; concurrent callers are rejected until that
+	// trial resolves via Success or Failure.
+	trialInFlight bool
+}
+
+// NewBreaker builds a Breaker that opens after threshold consecutive
+// failures and allows a trial request again after cooldown.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+// Allow reports whether a request should be attempted right now, given the
+// breaker's current state. It transitions Open -> HalfOpen once Cooldown
+// has elapsed. In HalfOpen, only the first caller is let through (and marks
+// trialInFlight); every concurrent caller is rejected until that trial
+// resolves via Success or Failure, so a half-recovered peer is never hit by
+// more than one probe at a time.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case Closed:
+		return true
+	case HalfOpen:
+		if b.trialInFlight {
+			return false
+		}
+		b.trialInFlight = true
+		return true
+	case Open:
+		if time.Since(b.openedAt) >= b.Cooldown {
+			b.setState(HalfOpen)
+			b.trialInFlight = true
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+// Success records a successful call, closing the breaker.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.trialInFlight = false
+	if b.state != Closed {
+		b.setState(Closed)
+	}
+}
+
+// Failure records a failed call, opening the breaker once Threshold
+// consecutive failures have been seen (or immediately if the failing call
+// was the HalfOpen trial).
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == HalfOpen {
+		b.trialInFlight = false
+		b.setState(Open)
+		return
+	}
+	b.failures++
+	if b.Threshold > 0 && b.failures >= b.Threshold {
+		b.setState(Open)
+	}
+}
+
+// State returns the breaker's current state.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// setState must be called with mu held.
+func (b *Breaker) setState(to State) {
+	from := b.state
+	if from == to {
+		return
+	}
+	b.state = to
+	if to == Open {
+		b.openedAt = time.Now()
+	}
+	if to == Closed {
+		b.failures = 0
+	}
+	if b.OnStateChange != nil {
+		b.OnStateChange(from, to)
+	}
+}
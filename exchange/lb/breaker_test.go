@@ -0,0 +1,119 @@
+package lb
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b := NewBreaker(3, time.Minute)
+	for i := 0; i < 2; i++ {
+		if !b.Allow() {
+			t.Fatalf("Allow() = false before threshold reached, want true")
+		}
+		b.Failure()
+	}
+	if b.State() != Closed {
+		t.Fatalf("State() = %v after 2 failures (threshold 3), want Closed", b.State())
+	}
+	b.Failure()
+	if b.State() != Open {
+		t.Fatalf("State() = %v after 3 failures (threshold 3), want Open", b.State())
+	}
+	if b.Allow() {
+		t.Fatalf("Allow() = true while Open and before Cooldown, want false")
+	}
+}
+
+func TestBreakerHalfOpensAfterCooldown(t *testing.T) {
+	b := NewBreaker(1, 10*time.Millisecond)
+	b.Allow()
+	b.Failure() // -> Open
+	if b.State() != Open {
+		t.Fatalf("State() = %v, want Open", b.State())
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatalf("Allow() = false after Cooldown elapsed, want true (HalfOpen trial)")
+	}
+	if b.State() != HalfOpen {
+		t.Fatalf("State() = %v, want HalfOpen", b.State())
+	}
+}
+
+func TestBreakerSuccessClosesFromHalfOpen(t *testing.T) {
+	b := NewBreaker(1, time.Millisecond)
+	b.Allow()
+	b.Failure() // -> Open
+	time.Sleep(5 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatalf("Allow() = false, want true (HalfOpen trial)")
+	}
+	b.Success()
+	if b.State() != Closed {
+		t.Fatalf("State() = %v after Success from HalfOpen, want Closed", b.State())
+	}
+	if !b.Allow() {
+		t.Fatalf("Allow() = false after closing, want true")
+	}
+}
+
+func TestBreakerFailureReopensFromHalfOpen(t *testing.T) {
+	b := NewBreaker(1, time.Millisecond)
+	b.Allow()
+	b.Failure() // -> Open
+	time.Sleep(5 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatalf("Allow() = false, want true (HalfOpen trial)")
+	}
+	b.Failure()
+	if b.State() != Open {
+		t.Fatalf("State() = %v after a failed HalfOpen trial, want Open", b.State())
+	}
+}
+
+// TestBreakerHalfOpenAllowsOnlyOneConcurrentTrial guards against the bug
+// where every concurrent caller was let through during HalfOpen: only one
+// of many simultaneous Allow() calls should succeed until the trial
+// resolves via Success or Failure.
+func TestBreakerHalfOpenAllowsOnlyOneConcurrentTrial(t *testing.T) {
+	b := NewBreaker(1, time.Millisecond)
+	b.Allow()
+	b.Failure() // -> Open
+	time.Sleep(5 * time.Millisecond)
+
+	const callers = 50
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	wg.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			defer wg.Done()
+			if b.Allow() {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 1 {
+		t.Fatalf("Allow() let %d concurrent HalfOpen callers through, want exactly 1", allowed)
+	}
+}
+
+func TestBreakerOnStateChangeFires(t *testing.T) {
+	var transitions [][2]State
+	b := NewBreaker(1, time.Millisecond)
+	b.OnStateChange = func(from, to State) {
+		transitions = append(transitions, [2]State{from, to})
+	}
+	b.Allow()
+	b.Failure() // Closed -> Open
+	if len(transitions) != 1 || transitions[0] != [2]State{Closed, Open} {
+		t.Fatalf("transitions = %v, want a single Closed->Open transition", transitions)
+	}
+}
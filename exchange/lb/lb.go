@@ -0,0 +1,186 @@
+// Package lb wraps the gRPC clients exchange.Propagate/Subscribe/PingAll use
+// with bounded retries, a per-peer circuit breaker, and load-balanced
+// selection across multiple known addresses for the same peer id. It exists
+// so a single dead peer cannot stall the propagation goroutines spawned by
+// SubmitReport/LearnReport or hold up AnalyzeReport's latency.
+package lb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+
+	"panorama/metrics"
+	"panorama/util/log"
+)
+
+// Config configures retry, breaker and selection behavior for every peer a
+// LoadBalancer dials. It mirrors HealthServerConfig.Exchange.
+type Config struct {
+	RetryMax         int           `json:"retry_max"`
+	RetryTimeout     time.Duration `json:"retry_timeout"`
+	BreakerThreshold int           `json:"breaker_threshold"`
+	BreakerCooldown  time.Duration `json:"breaker_cooldown"`
+}
+
+// LoadBalancer owns one connection pool + circuit breaker per peer id.
+type LoadBalancer struct {
+	cfg     Config
+	logger  log.Logger
+	metrics *metrics.Collector
+
+	mu    sync.Mutex
+	peers map[string]*peerPool
+}
+
+type peerPool struct {
+	mu      sync.Mutex
+	conns   []*grpc.ClientConn
+	next    int
+	breaker *Breaker
+}
+
+// New builds a LoadBalancer. logger and metrics may be nil, in which case
+// breaker transitions are neither logged nor exported.
+func New(cfg Config, logger log.Logger, collector *metrics.Collector) *LoadBalancer {
+	if logger == nil {
+		logger = log.NewNop()
+	}
+	return &LoadBalancer{
+		cfg:     cfg,
+		logger:  logger,
+		metrics: collector,
+		peers:   make(map[string]*peerPool),
+	}
+}
+
+// SetPeer (re)dials addrs for peer id, replacing whatever pool existed
+// before. Call it once for a peer learned statically from
+// HealthServerConfig.Peers and again whenever discovery.PeerEvent reports
+// a change.
+func (lb *LoadBalancer) SetPeer(id string, addrs []string) error {
+	conns := make([]*grpc.ClientConn, 0, len(addrs))
+	for _, addr := range addrs {
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return fmt.Errorf("lb: failed to dial %s for peer %s: %v", addr, id, err)
+		}
+		conns = append(conns, conn)
+	}
+
+	breaker := NewBreaker(lb.cfg.BreakerThreshold, lb.cfg.BreakerCooldown)
+	breaker.OnStateChange = func(from, to State) {
+		lb.logger.Info("circuit breaker state transition",
+			zap.String("peer", id), zap.String("from", from.String()), zap.String("to", to.String()))
+		if lb.metrics != nil {
+			lb.metrics.SetBreakerState(id, metricsState(to))
+		}
+	}
+
+	lb.mu.Lock()
+	old := lb.peers[id]
+	lb.peers[id] = &peerPool{conns: conns, breaker: breaker}
+	lb.mu.Unlock()
+
+	if old != nil {
+		old.closeAll()
+	}
+	return nil
+}
+
+// RemovePeer closes id's connections and drops it from the pool.
+func (lb *LoadBalancer) RemovePeer(id string) {
+	lb.mu.Lock()
+	pool, ok := lb.peers[id]
+	delete(lb.peers, id)
+	lb.mu.Unlock()
+	if ok {
+		pool.closeAll()
+	}
+}
+
+func (p *peerPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+}
+
+// nextConn round-robins across the peer's known addresses.
+func (p *peerPool) nextConn() (*grpc.ClientConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.conns) == 0 {
+		return nil, fmt.Errorf("lb: no known addresses for peer")
+	}
+	conn := p.conns[p.next%len(p.conns)]
+	p.next++
+	return conn, nil
+}
+
+// Call invokes fn against peer id's connection, applying the circuit
+// breaker and bounded retry+jitter. fn is retried against a (possibly
+// different, if more than one address is known) connection on failure.
+func (lb *LoadBalancer) Call(ctx context.Context, id string, fn func(conn *grpc.ClientConn) error) error {
+	lb.mu.Lock()
+	pool, ok := lb.peers[id]
+	lb.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("lb: unknown peer %s", id)
+	}
+	if !pool.breaker.Allow() {
+		return fmt.Errorf("lb: circuit breaker open for peer %s", id)
+	}
+
+	retryCfg := RetryConfig{Max: lb.cfg.RetryMax, Timeout: lb.cfg.RetryTimeout}
+	if pool.breaker.State() == HalfOpen {
+		// Allow() just granted the single HalfOpen trial; withRetry must not
+		// spend it on more than one attempt, or a still-recovering peer gets
+		// hit RetryMax times instead of the one probe the breaker promises.
+		retryCfg.Max = 1
+	}
+	err := withRetry(ctx, retryCfg, func() error {
+		conn, err := pool.nextConn()
+		if err != nil {
+			return err
+		}
+		return fn(conn)
+	})
+	if err != nil {
+		pool.breaker.Failure()
+	} else {
+		pool.breaker.Success()
+	}
+	return err
+}
+
+// BreakerState returns the current circuit breaker state for peer id, or
+// Closed if id is unknown.
+func (lb *LoadBalancer) BreakerState(id string) State {
+	lb.mu.Lock()
+	pool, ok := lb.peers[id]
+	lb.mu.Unlock()
+	if !ok {
+		return Closed
+	}
+	return pool.breaker.State()
+}
+
+func metricsState(s State) metrics.BreakerState {
+	switch s {
+	case Open:
+		return metrics.BreakerOpen
+	case HalfOpen:
+		return metrics.BreakerHalfOpen
+	default:
+		return metrics.BreakerClosed
+	}
+}
@@ -0,0 +1,52 @@
+package lb
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// RetryConfig bounds how Call retries a failing peer call.
+type RetryConfig struct {
+	// Max is the maximum number of attempts, including the first. Max <= 1
+	// disables retrying.
+	Max int
+	// Timeout is the base backoff: before retry N (N = 1, 2, ...) Call waits
+	// a random duration between half and all of Timeout*2^(N-1), that value
+	// being capped at 30s. Timeout <= 0 means retries follow immediately.
+	Timeout time.Duration
+}
+
+const maxBackoff = 30 * time.Second
+
+// withRetry calls fn, making at most cfg.Max attempts in all, with
+// exponential backoff and jitter between attempts. It stops early if ctx is
+// canceled.
+func withRetry(ctx context.Context, cfg RetryConfig, fn func() error) error {
+	attempts := cfg.Max
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			var backoff time.Duration
+			if cfg.Timeout > 0 {
+				backoff = cfg.Timeout << uint(attempt-1)
+				if backoff > maxBackoff || backoff <= 0 {
+					backoff = maxBackoff
+				}
+			}
+			jitter := time.Duration(rand.Int63n(int64(backoff) + 1))
+			select {
+			case <-time.After(backoff/2 + jitter/2):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWithRetrySucceedsWithoutRetrying(t *testing.T) {
+	calls := 0
+	err := withRetry(context.Background(), RetryConfig{Max: 3, Timeout: time.Millisecond}, func() error {
+		calls++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("withRetry() error = %v, want nil", err)
+	}
+	if calls != 1 {
+		t.Fatalf("withRetry() called fn %d times, want 1", calls)
+	}
+}
+
+func TestWithRetryRetriesUpToMax(t *testing.T) {
+	wantErr := errors.New("boom")
+	calls := 0
+	err := withRetry(context.Background(), RetryConfig{Max: 3, Timeout: time.Millisecond}, func() error {
+		calls++
+		return wantErr
+	})
+	if err != wantErr {
+		t.Fatalf("withRetry() error = %v, want %v", err, wantErr)
+	}
+	if calls != 3 {
+		t.Fatalf("withRetry() called fn %d times, want exactly Max=3", calls)
+	}
+}
+
+func TestWithRetryStopsOnFirstSuccess(t *testing.T) {
+	wantErr := errors.New("boom")
+	calls := 0
+	err := withRetry(context.Background(), RetryConfig{Max: 5, Timeout: time.Millisecond}, func() error {
+		calls++
+		if calls == 2 {
+			return nil
+		}
+		return wantErr
+	})
+	if err != nil {
+		t.Fatalf("withRetry() error = %v, want nil", err)
+	}
+	if calls != 2 {
+		t.Fatalf("withRetry() called fn %d times, want 2 (stop at first success)", calls)
+	}
+}
+
+func TestWithRetryMaxBelowOneMeansOneAttempt(t *testing.T) {
+	calls := 0
+	withRetry(context.Background(), RetryConfig{Max: 0, Timeout: time.Millisecond}, func() error {
+		calls++
+		return errors.New("boom")
+	})
+	if calls != 1 {
+		t.Fatalf("withRetry() with Max=0 called fn %d times, want 1", calls)
+	}
+}
+
+func TestWithRetryAbortsOnContextCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := withRetry(ctx, RetryConfig{Max: 5, Timeout: 50 * time.Millisecond}, func() error {
+		calls++
+		if calls == 1 {
+			cancel()
+		}
+		return errors.New("boom")
+	})
+	if err != context.Canceled {
+		t.Fatalf("withRetry() error = %v, want context.Canceled", err)
+	}
+	if calls != 1 {
+		t.Fatalf("withRetry() called fn %d times after cancellation, want 1", calls)
+	}
+}
@@ -0,0 +1,181 @@
+// Package metrics wires the health service into Prometheus so operators can
+// scrape report ingestion rate, inference latency and peer health the same
+// way they scrape any other production component.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+)
+
+// Collector owns the registry of RED metrics (rate, errors, duration) for
+// the gRPC service plus the handful of gauges the service exposes about its
+// own internal state.
+type Collector struct {
+	registry *prometheus.Registry
+
+	requestsTotal   *prometheus.CounterVec
+	errorsTotal     *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+
+	subjectsCount     prometheus.Gauge
+	holdBufferSize    prometheus.Gauge
+	registrationCount prometheus.Gauge
+	nextHandle        prometheus.Gauge
+	peerRTT           *prometheus.GaugeVec
+	breakerState      *prometheus.GaugeVec
+
+	server *http.Server
+}
+
+// New creates a Collector and registers all of its metrics on a fresh
+// registry, so multiple HealthGServer instances in the same process (as in
+// tests) never collide on Prometheus's default registry.
+func New() *Collector {
+	c := &Collector{registry: prometheus.NewRegistry()}
+
+	c.requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "panorama",
+		Subsystem: "grpc",
+		Name:      "requests_total",
+		Help:      "Total number of RPCs received, labeled by method.",
+	}, []string{"method"})
+
+	c.errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "panorama",
+		Subsystem: "grpc",
+		Name:      "errors_total",
+		Help:      "Total number of RPCs that returned an error, labeled by method.",
+	}, []string{"method"})
+
+	c.requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "panorama",
+		Subsystem: "grpc",
+		Name:      "request_duration_seconds",
+		Help:      "RPC latency distribution, labeled by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	c.subjectsCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "panorama",
+		Name:      "subjects_count",
+		Help:      "Number of subjects currently being observed.",
+	})
+
+	c.holdBufferSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "panorama",
+		Name:      "hold_buffer_size",
+		Help:      "Number of reports currently sitting in the hold buffer.",
+	})
+
+	c.registrationCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "panorama",
+		Name:      "registrations_count",
+		Help:      "Number of active observer registrations.",
+	})
+
+	c.nextHandle = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "panorama",
+		Name:      "next_handle",
+		Help:      "Next registration handle that will be assigned.",
+	})
+
+	c.peerRTT = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "panorama",
+		Subsystem: "exchange",
+		Name:      "peer_rtt_seconds",
+		Help:      "Round-trip time of the last successful Ping to a peer.",
+	}, []string{"peer"})
+
+	c.breakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "panorama",
+		Subsystem: "exchange",
+		Name:      "circuit_breaker_state",
+		Help:      "Circuit breaker state per peer (0=closed, 1=open, 2=half-open).",
+	}, []string{"peer"})
+
+	c.registry.MustRegister(
+		c.requestsTotal, c.errorsTotal, c.requestDuration,
+		c.subjectsCount, c.holdBufferSize, c.registrationCount, c.nextHandle,
+		c.peerRTT, c.breakerState,
+	)
+	return c
+}
+
+// UnaryServerInterceptor records request count, error count and latency for
+// every RPC. Install it with grpc.UnaryInterceptor in Start().
+func (c *Collector) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		c.requestsTotal.WithLabelValues(info.FullMethod).Inc()
+		c.requestDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+		if err != nil {
+			c.errorsTotal.WithLabelValues(info.FullMethod).Inc()
+		}
+		return resp, err
+	}
+}
+
+// SetSubjectsCount, SetHoldBufferSize, SetRegistrationCount and SetNextHandle
+// are called periodically (e.g. from GC) to refresh the service's gauges.
+func (c *Collector) SetSubjectsCount(n int)     { c.subjectsCount.Set(float64(n)) }
+func (c *Collector) SetHoldBufferSize(n int)    { c.holdBufferSize.Set(float64(n)) }
+func (c *Collector) SetRegistrationCount(n int) { c.registrationCount.Set(float64(n)) }
+func (c *Collector) SetNextHandle(h uint64)     { c.nextHandle.Set(float64(h)) }
+
+// ObservePeerRTT records the round trip time of the last successful ping to
+// peer, as gathered by exchange.PingAll.
+func (c *Collector) ObservePeerRTT(peer string, rtt time.Duration) {
+	c.peerRTT.WithLabelValues(peer).Set(rtt.Seconds())
+}
+
+// BreakerState mirrors exchange/lb.State so that package can report circuit
+// breaker transitions without this package importing it (exchange/lb
+// already imports metrics, to avoid a cycle).
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+// SetBreakerState records the current circuit breaker state for peer.
+func (c *Collector) SetBreakerState(peer string, state BreakerState) {
+	c.breakerState.WithLabelValues(peer).Set(float64(state))
+}
+
+// Start exposes the registry and a /healthz liveness probe (consumed by the
+// Consul discovery backend's HTTP health check) on addr. It
+// returns immediately; the listener runs in its own goroutine and reports a
+// fatal bind error on errch.
+func (c *Collector) Start(addr string, errch chan error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(c.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+	c.server = &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := c.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			if errch != nil {
+				errch <- err
+			}
+		}
+	}()
+}
+
+// Stop shuts the metrics listener down.
+func (c *Collector) Stop(ctx context.Context) error {
+	if c.server == nil {
+		return nil
+	}
+	return c.server.Shutdown(ctx)
+}
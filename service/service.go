@@ -8,16 +8,20 @@ import (
 
 	"github.com/golang/protobuf/ptypes"
 	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	"go.uber.org/zap"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
 
 	pb "panorama/build/gen"
 	"panorama/decision"
+	"panorama/discovery"
 	"panorama/exchange"
+	"panorama/exchange/lb"
+	"panorama/metrics"
 	"panorama/store"
 	dt "panorama/types"
-	du "panorama/util"
+	"panorama/util/log"
 )
 
 const (
@@ -44,6 +48,10 @@ type HealthGServer struct {
 	inference   dt.HealthInference
 	exchange    dt.HealthExchange
 	hold_buffer *store.CacheList
+	logger      log.Logger
+	metrics     *metrics.Collector
+	discoverer  discovery.Discoverer
+	journal     *store.ReportJournal
 
 	// registrations from prior run (e.g., instance restarted)
 	old_registrations map[uint64]*dt.Registration
@@ -53,11 +61,23 @@ type HealthGServer struct {
 
 	l net.Listener
 	s *grpc.Server
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 func NewHealthGServer(config *dt.HealthServerConfig) *HealthGServer {
 	gs := new(HealthGServer)
 	gs.HealthServerConfig = *config
+	logger, err := log.New(config.LogConfig, stag)
+	if err != nil {
+		// fall back to a discarding logger rather than failing construction
+		// over a bad logging config
+		logger = log.NewNop()
+	}
+	gs.logger = logger
+	gs.metrics = metrics.New()
 	storage := store.NewRawHealthStorage(config.Subjects...)
 	gs.storage = storage
 	gs.registrations = make(map[uint64]*dt.Registration)
@@ -83,20 +103,28 @@ func NewHealthGServer(config *dt.HealthServerConfig) *HealthGServer {
 	var majority decision.SimpleMajorityInference
 	infs := store.NewHealthInferenceStorage(storage, majority)
 	gs.inference = infs
-	gs.exchange = exchange.NewExchangeProtocol(config)
+	// A fresh logger, not gs.logger.With(...), so the exchange subsystem
+	// gets exactly one "subsystem" field (xtag) instead of gs.logger's
+	// "subsystem":"service" plus a second one appended on top of it.
+	exchangeLogger, err := log.New(config.LogConfig, "xtag")
+	if err != nil {
+		exchangeLogger = log.NewNop()
+	}
+	gs.exchange = exchange.NewExchangeProtocol(config, lb.New(config.Exchange, exchangeLogger, gs.metrics))
 	return gs
 }
 
-func (self *HealthGServer) Start(errch chan error) error {
+func (self *HealthGServer) Start(ctx context.Context, errch chan error) error {
 	if self.s != nil {
 		return fmt.Errorf("HealthGServer is already started\n")
 	}
+	self.ctx, self.cancel = context.WithCancel(ctx)
 	lis, err := net.Listen("tcp", self.Addr)
 	if err != nil {
 		return fmt.Errorf("Fail to register RPC server at %s\n", self.Addr)
 	}
 	self.l = lis
-	self.s = grpc.NewServer()
+	self.s = grpc.NewServer(grpc.UnaryInterceptor(self.metrics.UnaryServerInterceptor()))
 	pb.RegisterHealthServiceServer(self.s, self)
 	// Register reflection service on gRPC server.
 	reflection.Register(self.s)
@@ -112,22 +140,61 @@ func (self *HealthGServer) Start(errch chan error) error {
 	} else {
 		self.db = store.NewHealthDBStorage(DEFAULT_DBFILE)
 	}
-	_, err = self.db.Open()
+	_, err = self.db.Open(self.ctx)
 	if err == nil {
 		self.storage.SetDB(self.db)
 		self.inference.SetDB(self.db)
 		// read old registrations
-		self.old_registrations, _ = self.db.ReadRegistrations()
+		self.old_registrations, _ = self.db.ReadRegistrations(self.ctx)
+	}
+	if len(self.JournalDir) > 0 {
+		if err := self.openJournal(); err != nil {
+			self.logger.Error("failed to open report journal", zap.String("dir", self.JournalDir), zap.Error(err))
+		}
 	}
 	self.inference.Start()
-	self.exchange.PingAll()
+	rtts := self.exchange.PingAll(self.ctx)
+	for peer, rtt := range rtts {
+		self.metrics.ObservePeerRTT(peer, rtt)
+	}
+	if len(self.MetricsAddr) > 0 {
+		self.metrics.Start(self.MetricsAddr, errch)
+	}
+	if len(self.Discovery.Type) > 0 {
+		if len(self.MetricsAddr) > 0 {
+			// Lets the Consul backend register an HTTP health check against
+			// our own /healthz instead of a GRPC check nothing here serves.
+			self.Discovery.HealthCheckURL = fmt.Sprintf("http://%s/healthz", self.MetricsAddr)
+		}
+		self.discoverer, err = discovery.New(self.Discovery)
+		if err != nil {
+			self.logger.Error("failed to initialize service discovery", zap.String("type", self.Discovery.Type), zap.Error(err))
+		} else if err := self.discoverer.Register(self.Id, self.Addr); err != nil {
+			self.logger.Error("failed to register with service discovery", zap.Error(err))
+		} else {
+			self.spawn(self.watchPeers)
+		}
+	}
 	if gc_frequency > 0 {
 		// set GC frequency to negative to disable GC
-		go self.GC()
+		self.spawn(self.GC)
 	}
 	return nil
 }
 
+// spawn runs f in a goroutine tracked by self.wg, so Stop can wait for the
+// background work the server starts this way (GC, the discovery watcher,
+// report analysis, propagation and subscription calls) to actually exit
+// before tearing down storage. The inference engine's own workers, started
+// by inference.Start(), are not tracked by self.wg.
+func (self *HealthGServer) spawn(f func()) {
+	self.wg.Add(1)
+	go func() {
+		defer self.wg.Done()
+		f()
+	}()
+}
+
 func (self *HealthGServer) Stop(graceful bool) error {
 	if self.s == nil {
 		return fmt.Errorf("HealthGServer has not started\n")
@@ -139,10 +206,26 @@ func (self *HealthGServer) Stop(graceful bool) error {
 	}
 	self.s = nil
 	self.l = nil
+	self.cancel()
+	if self.discoverer != nil {
+		// Close deregisters this instance and ends the discoverer's watch
+		// loop, closing Watch()'s channel; watchPeers (tracked in self.wg)
+		// returns on that or on the self.cancel() above.
+		self.discoverer.Close()
+	}
+	self.wg.Wait() // wait for spawned GC, analysis, propagation and watcher goroutines to exit
+	// inference.Stop ends the inference workers, which self.wg does not track
 	self.inference.Stop()
+	if self.journal != nil {
+		self.journal.Close()
+	}
 	if self.db != nil {
-		self.db.Close()
+		self.db.Close(self.ctx)
+	}
+	if len(self.MetricsAddr) > 0 {
+		self.metrics.Stop(context.Background())
 	}
+	self.logger.Sync()
 	return nil
 }
 
@@ -168,7 +251,8 @@ func (self *HealthGServer) Register(ctx context.Context, in *pb.RegisterRequest)
 	observer := dt.ObserverModule{Module: in.Module, Observer: in.Observer}
 	registration := &dt.Registration{ObserverModule: observer, Handle: max_handle, Time: now}
 	self.registrations[max_handle] = registration
-	du.LogD(stag, "received register request from (%s,%s), assigned handle %d", in.Module, in.Observer, max_handle)
+	self.logger.Debug("received register request",
+		zap.String("module", in.Module), zap.String("observer", in.Observer), zap.Uint64("handle", max_handle))
 	if self.db != nil {
 		self.db.InsertRegistration(registration)
 	}
@@ -185,7 +269,8 @@ func (self *HealthGServer) SubmitReport(ctx context.Context, in *pb.SubmitReport
 			// If we have old registrations, we might have just crashed and forgot
 			// about the handles we allocated. So we should check the old registrations
 			// if we cannot find the handle in the new registrations
-			du.LogD(stag, "Tried to check old registrations %v for handle %d", self.old_registrations, in.Handle)
+			self.logger.Debug("checking old registrations for handle",
+				zap.Any("old_registrations", self.old_registrations), zap.Uint64("handle", in.Handle))
 			old_reg, ok := self.old_registrations[in.Handle]
 			if ok {
 				if old_reg.Observer == in.Report.Observer {
@@ -195,12 +280,13 @@ func (self *HealthGServer) SubmitReport(ctx context.Context, in *pb.SubmitReport
 					// add this observer into watch list
 					self.storage.AddSubject(old_reg.Observer)
 					valid = true
-					du.LogI(stag, "Restored an registration from %s in the old registrations", old_reg.Observer)
+					self.logger.Info("restored a registration from old registrations", zap.String("observer", old_reg.Observer))
 				} else {
-					du.LogI(stag, "Found handle in old registrations but observer does not match: %s vs. %s ", old_reg.Observer, in.Report.Observer)
+					self.logger.Info("found handle in old registrations but observer does not match",
+						zap.String("old_observer", old_reg.Observer), zap.String("new_observer", in.Report.Observer))
 				}
 			} else {
-				du.LogI(stag, "Could not find old registration either for handle %d", in.Handle)
+				self.logger.Info("could not find old registration either", zap.Uint64("handle", in.Handle))
 			}
 		}
 		if !valid {
@@ -219,7 +305,7 @@ func (self *HealthGServer) SubmitReport(ctx context.Context, in *pb.SubmitReport
 
 	report := in.Report
 	var result pb.SubmitReportReply_Status
-	du.LogD(stag, "submitting report about %s", report.Subject)
+	self.logger.Debug("submitting report", zap.String("subject", report.Subject))
 	rc, err := self.storage.AddReport(report, false) // never ignore local reports
 	switch rc {
 	case store.REPORT_IGNORED:
@@ -228,10 +314,11 @@ func (self *HealthGServer) SubmitReport(ctx context.Context, in *pb.SubmitReport
 		result = pb.SubmitReportReply_FAILED
 	case store.REPORT_ACCEPTED:
 		result = pb.SubmitReportReply_ACCEPTED
-		du.LogD(stag, "accepted report about %s, analyzing...", report.Subject)
-		go self.AnalyzeReport(report, true)
-		du.LogD(stag, "propagating report about %s", report.Subject)
-		go self.exchange.Propagate(report)
+		self.journalReport(report)
+		self.logger.Debug("accepted report, analyzing", zap.String("subject", report.Subject))
+		self.spawn(func() { self.AnalyzeReport(report, true) })
+		self.logger.Debug("propagating report", zap.String("subject", report.Subject))
+		self.spawn(func() { self.exchange.Propagate(self.ctx, report) })
 	}
 	return &pb.SubmitReportReply{Result: result}, err
 }
@@ -241,33 +328,39 @@ func (self *HealthGServer) LearnReport(ctx context.Context, in *pb.LearnReportRe
 	switch in.Kind {
 	case pb.LearnReportRequest_NORMAL:
 		{
-			du.LogD(stag, "learning report about %s from %s at %s", report.Subject, report.Observer, in.Source.Id)
+			self.logger.Debug("learning report",
+				zap.String("subject", report.Subject), zap.String("observer", report.Observer), zap.String("source", in.Source.Id))
 			var result pb.LearnReportReply_Status
 			rc, err := self.storage.AddReport(report, self.FilterSubmission)
 			switch rc {
 			case store.REPORT_IGNORED:
 				result = pb.LearnReportReply_IGNORED
-				du.LogD(stag, "ignored about report %s from %s at %s", report.Subject, report.Observer, in.Source.Id)
+				self.logger.Debug("ignored report",
+					zap.String("subject", report.Subject), zap.String("observer", report.Observer), zap.String("source", in.Source.Id))
 				self.hold_buffer.Set(report.Subject, report) // put this report on hold for a while
 			case store.REPORT_FAILED:
 				result = pb.LearnReportReply_FAILED
 			case store.REPORT_ACCEPTED:
 				result = pb.LearnReportReply_ACCEPTED
-				du.LogD(stag, "accepted report %s from %s at %s", report.Subject, report.Observer, in.Source.Id)
+				self.journalReport(report)
+				self.logger.Debug("accepted report",
+					zap.String("subject", report.Subject), zap.String("observer", report.Observer), zap.String("source", in.Source.Id))
 				self.exchange.Interested(in.Source.Id, report.Subject)
-				go self.AnalyzeReport(report, false)
+				self.spawn(func() { self.AnalyzeReport(report, false) })
 			}
 			return &pb.LearnReportReply{Result: result}, err
 		}
 	case pb.LearnReportRequest_SUBSCRIPTION:
 		{
-			du.LogI(stag, "got a subscription request about %s from %s at %s", report.Subject, report.Observer, in.Source.Id)
+			self.logger.Info("got a subscription request",
+				zap.String("subject", report.Subject), zap.String("observer", report.Observer), zap.String("source", in.Source.Id))
 			self.exchange.Interested(in.Source.Id, report.Subject)
 			return &pb.LearnReportReply{Result: pb.LearnReportReply_ACCEPTED}, nil
 		}
 	case pb.LearnReportRequest_UNSUBSCRIPTION:
 		{
-			du.LogI(stag, "got a unsubscription request about %s from %s at %s", report.Subject, report.Observer, in.Source.Id)
+			self.logger.Info("got an unsubscription request",
+				zap.String("subject", report.Subject), zap.String("observer", report.Observer), zap.String("source", in.Source.Id))
 			self.exchange.Uninterested(in.Source.Id, report.Subject)
 			return &pb.LearnReportReply{Result: pb.LearnReportReply_ACCEPTED}, nil
 		}
@@ -309,13 +402,13 @@ func (self *HealthGServer) GetInference(ctx context.Context, in *pb.GetInference
 
 func (self *HealthGServer) Observe(ctx context.Context, in *pb.ObserveRequest) (*pb.ObserveReply, error) {
 	ok := self.storage.AddSubject(in.Subject)
-	go self.exchange.Subscribe(in.Subject) // tell others I'd like to subscribe to subject
+	self.spawn(func() { self.exchange.Subscribe(self.ctx, in.Subject) }) // tell others I'd like to subscribe to subject
 	return &pb.ObserveReply{Success: ok}, nil
 }
 
 func (self *HealthGServer) StopObserving(ctx context.Context, in *pb.ObserveRequest) (*pb.ObserveReply, error) {
 	ok := self.storage.RemoveSubject(in.Subject, true)
-	go self.exchange.Unsubscribe(in.Subject) // tell others I'd like to subscribe to subject
+	self.spawn(func() { self.exchange.Unsubscribe(self.ctx, in.Subject) }) // tell others I'd like to subscribe to subject
 	return &pb.ObserveReply{Success: ok}, nil
 }
 
@@ -345,7 +438,7 @@ func (self *HealthGServer) Ping(ctx context.Context, in *pb.PingRequest) (*pb.Pi
 	if err != nil {
 		return nil, err
 	}
-	du.LogD(stag, "got ping request from %s at time %s", in.Source.Id, ts)
+	self.logger.Debug("got ping request", zap.String("source", in.Source.Id), zap.Time("sent_at", ts))
 	now := time.Now()
 	pnow, err := ptypes.TimestampProto(now)
 	if err != nil {
@@ -355,41 +448,134 @@ func (self *HealthGServer) Ping(ctx context.Context, in *pb.PingRequest) (*pb.Pi
 }
 
 func (self *HealthGServer) GC() {
-	for self.s != nil {
-		time.Sleep(gc_frequency)
-		retired := self.storage.GC(gc_threshold, gc_relative) // retired reports older then GC_THREASHOLD
+	for {
+		select {
+		case <-self.ctx.Done():
+			return
+		case <-time.After(gc_frequency):
+		}
+		self.refreshGauges()
+		retired := self.storage.GC(self.ctx, gc_threshold, gc_relative) // retired reports older then GC_THREASHOLD
 		if retired != nil && len(retired) != 0 {
 			for subject, r := range retired {
-				du.LogD(stag, "Retired %d observations for %s", r, subject)
+				self.logger.Debug("retired observations", zap.Int("count", r), zap.String("subject", subject))
 				// TODO: update inference result here
-				self.inference.InferSubjectAsync(subject)
+				self.inference.InferSubjectAsync(self.ctx, subject)
 			}
 		} else {
-			du.LogD(stag, "No observations retired at this GC round")
+			self.logger.Debug("no observations retired at this GC round")
 		}
 	}
 }
 
+// journalReport appends an accepted report to the write-ahead journal, if
+// one is configured. A failure here is logged, not surfaced to the caller:
+// the report has already been durably accepted into storage, and the
+// journal is a secondary audit/recovery trail rather than the source of
+// truth.
+func (self *HealthGServer) journalReport(report *pb.Report) {
+	if self.journal == nil {
+		return
+	}
+	if err := self.journal.Append(report); err != nil {
+		self.logger.Error("failed to append report to journal", zap.String("subject", report.Subject), zap.Error(err))
+	}
+}
+
+// openJournal opens the report journal, replays every record appended since
+// the checkpoint stored in the db (from the start of the journal when there
+// is none) back into storage, and then stores the new checkpoint. Start
+// calls it before the server begins serving traffic.
+func (self *HealthGServer) openJournal() error {
+	journal, err := store.NewReportJournal(self.JournalDir, self.JournalMaxSizeMB, self.JournalMaxBackups, self.JournalMaxAgeDays)
+	if err != nil {
+		return err
+	}
+	self.journal = journal
+
+	var checkpoint store.JournalOffset
+	if self.db != nil {
+		checkpoint, _ = self.db.ReadJournalOffset(self.ctx)
+	}
+	next, err := journal.Replay(checkpoint, func(report *pb.Report) error {
+		_, err := self.storage.AddReport(report, false)
+		return err
+	})
+	if err != nil {
+		self.logger.Error("journal replay stopped early", zap.Error(err))
+	}
+	if self.db != nil {
+		self.db.WriteJournalOffset(self.ctx, next)
+	}
+	return nil
+}
+
+// watchPeers reconciles the exchange peer table as the discovery backend
+// reports peers joining or leaving the service. It also selects on
+// self.ctx.Done() as a second line of defense: Stop() already closes the
+// discoverer (which closes Watch()'s channel) before waiting on self.wg,
+// but bailing out on ctx cancellation too means a discoverer bug that
+// forgets to close its events channel can no longer wedge Stop forever.
+func (self *HealthGServer) watchPeers() {
+	events := self.discoverer.Watch()
+	for {
+		select {
+		case <-self.ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			switch event.Type {
+			case discovery.PeerAdded:
+				self.logger.Info("discovered new peer", zap.String("peer", event.Id), zap.String("addr", event.Addr))
+				self.exchange.AddPeer(event.Id, event.Addr)
+				rtts := self.exchange.PingAll(self.ctx)
+				for peer, rtt := range rtts {
+					self.metrics.ObservePeerRTT(peer, rtt)
+				}
+			case discovery.PeerRemoved:
+				self.logger.Info("peer left", zap.String("peer", event.Id), zap.String("addr", event.Addr))
+				self.exchange.RemovePeer(event.Id)
+			}
+		}
+	}
+}
+
+// refreshGauges republishes the service's internal state as Prometheus
+// gauges; it's cheap enough to call once per GC round.
+func (self *HealthGServer) refreshGauges() {
+	self.metrics.SetSubjectsCount(len(self.storage.GetSubjects()))
+	self.metrics.SetHoldBufferSize(self.hold_buffer.Len())
+	self.regMu.Lock()
+	self.metrics.SetRegistrationCount(len(self.registrations))
+	self.metrics.SetNextHandle(self.next_handle)
+	self.regMu.Unlock()
+}
+
 func (self *HealthGServer) AnalyzeReport(report *pb.Report, check_hold bool) {
 	if check_hold {
 		items := self.hold_buffer.Get(report.Subject)
 		if items != nil && len(items) > 0 {
-			du.LogI(stag, "found %d recent reports about %s in hold buffer", len(items), report.Subject)
+			self.logger.Info("found recent reports in hold buffer", zap.Int("count", len(items)), zap.String("subject", report.Subject))
 			for _, item := range items {
 				r := item.Value.(*pb.Report)
 				_, err := self.storage.AddReport(r, false)
 				if err != nil {
-					du.LogE(stag, "fail to add hold buffer report %s->%s", r.Observer, r.Subject)
+					self.logger.Error("failed to add hold buffer report",
+						zap.String("observer", r.Observer), zap.String("subject", r.Subject), zap.Error(err))
 				} else {
-					du.LogD(stag, "hold buffer report %s->%s successfully added back to storage", r.Observer, r.Subject)
+					self.logger.Debug("hold buffer report added back to storage",
+						zap.String("observer", r.Observer), zap.String("subject", r.Subject))
 				}
 			}
-			self.hold_buffer.Empty(report.Subject)     // clear the report from hold buffer
-			go self.exchange.Subscribe(report.Subject) // tell others I'd like to subscribe to subject
+			self.hold_buffer.Empty(report.Subject) // clear the report from hold buffer
+			subject := report.Subject
+			self.spawn(func() { self.exchange.Subscribe(self.ctx, subject) }) // tell others I'd like to subscribe to subject
 		}
 	}
-	du.LogD(stag, "sent report for %s for inference", report.Subject)
-	self.inference.InferReportAsync(report)
+	self.logger.Debug("sent report for inference", zap.String("subject", report.Subject))
+	self.inference.InferReportAsync(self.ctx, report)
 }
 
 func (self *HealthGServer) GetPeers(ctx context.Context, in *pb.Empty) (*pb.GetPeerReply, error) {
@@ -0,0 +1,272 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "panorama/build/gen"
+)
+
+// ReportJournal is a write-ahead log of every report accepted by
+// SubmitReport/LearnReport. It exists so a crash between accepting a report
+// and the sqlite db flushing it does not lose data, and so the raw report
+// stream can be shipped off-host for audit without bloating deephealth.db.
+//
+// Entries are length-prefixed, protobuf-encoded pb.Report records appended
+// to reports-NNN.log files under Dir, rotating once a segment reaches
+// MaxSizeMB and pruning segments beyond MaxBackups or older than MaxAgeDays.
+type ReportJournal struct {
+	dir          string
+	maxSizeBytes int64
+	maxBackups   int
+	maxAge       time.Duration
+
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	seq    int
+}
+
+// JournalOffset identifies a position within the journal: segment is the
+// sequence number of a reports-NNN.log file and pos is a byte offset into
+// it. It is what HealthDB persists as the replay checkpoint.
+type JournalOffset struct {
+	Segment int
+	Pos     int64
+}
+
+var journalFileRe = regexp.MustCompile(`^reports-(\d+)\.log$`)
+
+func journalFileName(seq int) string {
+	return fmt.Sprintf("reports-%03d.log", seq)
+}
+
+// NewReportJournal opens (creating if necessary) the journal rooted at dir,
+// resuming from the highest-numbered existing segment.
+func NewReportJournal(dir string, maxSizeMB, maxBackups, maxAgeDays int) (*ReportJournal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create journal dir %s: %v", dir, err)
+	}
+	j := &ReportJournal{
+		dir:          dir,
+		maxSizeBytes: int64(maxSizeMB) * 1024 * 1024,
+		maxBackups:   maxBackups,
+		maxAge:       time.Duration(maxAgeDays) * 24 * time.Hour,
+	}
+	segments, err := j.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		j.seq = segments[len(segments)-1]
+	}
+	if err := j.openCurrent(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *ReportJournal) segments() ([]int, error) {
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []int
+	for _, entry := range entries {
+		m := journalFileRe.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+		var seq int
+		fmt.Sscanf(m[1], "%d", &seq)
+		segs = append(segs, seq)
+	}
+	sort.Ints(segs)
+	return segs, nil
+}
+
+func (j *ReportJournal) openCurrent() error {
+	path := filepath.Join(j.dir, journalFileName(j.seq))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.file = f
+	j.writer = bufio.NewWriter(f)
+	j.size = info.Size()
+	return nil
+}
+
+// Append encodes report and appends it to the current segment, rotating and
+// pruning old segments if the size limit has been reached.
+func (j *ReportJournal) Append(report *pb.Report) error {
+	payload, err := proto.Marshal(report)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var lenbuf [4]byte
+	binary.BigEndian.PutUint32(lenbuf[:], uint32(len(payload)))
+	if _, err := j.writer.Write(lenbuf[:]); err != nil {
+		return err
+	}
+	if _, err := j.writer.Write(payload); err != nil {
+		return err
+	}
+	if err := j.writer.Flush(); err != nil {
+		return err
+	}
+	j.size += int64(len(lenbuf) + len(payload))
+
+	if j.maxSizeBytes > 0 && j.size >= j.maxSizeBytes {
+		return j.rotateLocked()
+	}
+	return nil
+}
+
+func (j *ReportJournal) rotateLocked() error {
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	j.seq++
+	if err := j.openCurrent(); err != nil {
+		return err
+	}
+	return j.pruneLocked()
+}
+
+func (j *ReportJournal) pruneLocked() error {
+	segs, err := j.segments()
+	if err != nil {
+		return err
+	}
+	// never prune the segment currently being written to
+	var sealed []int
+	for _, seq := range segs {
+		if seq != j.seq {
+			sealed = append(sealed, seq)
+		}
+	}
+	if j.maxBackups > 0 && len(sealed) > j.maxBackups {
+		for _, seq := range sealed[:len(sealed)-j.maxBackups] {
+			os.Remove(filepath.Join(j.dir, journalFileName(seq)))
+		}
+		sealed = sealed[len(sealed)-j.maxBackups:]
+	}
+	if j.maxAge > 0 {
+		cutoff := time.Now().Add(-j.maxAge)
+		for _, seq := range sealed {
+			path := filepath.Join(j.dir, journalFileName(seq))
+			if info, err := os.Stat(path); err == nil && info.ModTime().Before(cutoff) {
+				os.Remove(path)
+			}
+		}
+	}
+	return nil
+}
+
+// Replay reads every record from offset onward across all segments,
+// invoking fn for each, and returns the offset to checkpoint next so a
+// future replay resumes where this one left off.
+func (j *ReportJournal) Replay(offset JournalOffset, fn func(*pb.Report) error) (JournalOffset, error) {
+	segs, err := j.segments()
+	if err != nil {
+		return offset, err
+	}
+	for _, seq := range segs {
+		if seq < offset.Segment {
+			continue
+		}
+		startPos := int64(0)
+		if seq == offset.Segment {
+			startPos = offset.Pos
+		}
+		pos, err := j.replaySegment(seq, startPos, fn)
+		if err != nil {
+			return JournalOffset{Segment: seq, Pos: pos}, err
+		}
+		offset = JournalOffset{Segment: seq, Pos: pos}
+	}
+	return offset, nil
+}
+
+func (j *ReportJournal) replaySegment(seq int, startPos int64, fn func(*pb.Report) error) (int64, error) {
+	path := filepath.Join(j.dir, journalFileName(seq))
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return startPos, nil
+		}
+		return startPos, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(startPos, io.SeekStart); err != nil {
+		return startPos, err
+	}
+	reader := bufio.NewReader(f)
+	pos := startPos
+	for {
+		var lenbuf [4]byte
+		if _, err := io.ReadFull(reader, lenbuf[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return pos, err
+		}
+		size := binary.BigEndian.Uint32(lenbuf[:])
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			// A truncated trailing record means a crash mid-write: stop
+			// replaying this segment rather than failing for everything
+			// before it, but also truncate the file back to pos now. The
+			// current segment is reopened with O_APPEND, so leaving the
+			// orphaned length prefix/partial payload in place would make
+			// the next Append write a valid frame directly after garbage,
+			// destroying frame alignment for everything appended from here
+			// on; truncating first means the segment ends cleanly at pos
+			// and the next Append starts a fresh, well-formed frame there.
+			if terr := os.Truncate(path, pos); terr != nil {
+				return pos, fmt.Errorf("failed to truncate torn tail in %s at %d: %v", path, pos, terr)
+			}
+			break
+		}
+		report := new(pb.Report)
+		if err := proto.Unmarshal(payload, report); err != nil {
+			return pos, err
+		}
+		if err := fn(report); err != nil {
+			return pos, err
+		}
+		pos += int64(len(lenbuf) + len(payload))
+	}
+	return pos, nil
+}
+
+// Close flushes and closes the current segment.
+func (j *ReportJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.writer.Flush(); err != nil {
+		return err
+	}
+	return j.file.Close()
+}
@@ -0,0 +1,224 @@
+package store
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+
+	pb "panorama/build/gen"
+)
+
+func mustNewJournal(t *testing.T, maxSizeMB, maxBackups, maxAgeDays int) (*ReportJournal, string) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "report_journal_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	j, err := NewReportJournal(dir, maxSizeMB, maxBackups, maxAgeDays)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("NewReportJournal() error = %v", err)
+	}
+	return j, dir
+}
+
+func TestReportJournalAppendAndReplay(t *testing.T) {
+	j, dir := mustNewJournal(t, 0, 0, 0)
+	defer os.RemoveAll(dir)
+	defer j.Close()
+
+	reports := []*pb.Report{
+		{Subject: "a", Observer: "o1"},
+		{Subject: "b", Observer: "o2"},
+		{Subject: "c", Observer: "o3"},
+	}
+	for _, r := range reports {
+		if err := j.Append(r); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+
+	var got []*pb.Report
+	final, err := j.Replay(JournalOffset{}, func(r *pb.Report) error {
+		got = append(got, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+	if len(got) != len(reports) {
+		t.Fatalf("Replay() returned %d reports, want %d", len(got), len(reports))
+	}
+	for i, r := range got {
+		if r.Subject != reports[i].Subject || r.Observer != reports[i].Observer {
+			t.Errorf("report %d = %+v, want %+v", i, r, reports[i])
+		}
+	}
+
+	// Replaying again from the checkpoint returned above should yield
+	// nothing new, since nothing has been appended since.
+	var replayed int
+	if _, err := j.Replay(final, func(*pb.Report) error {
+		replayed++
+		return nil
+	}); err != nil {
+		t.Fatalf("Replay() from checkpoint error = %v", err)
+	}
+	if replayed != 0 {
+		t.Errorf("Replay() from checkpoint replayed %d reports, want 0", replayed)
+	}
+}
+
+func TestReportJournalReplayResumesFromOffset(t *testing.T) {
+	j, dir := mustNewJournal(t, 0, 0, 0)
+	defer os.RemoveAll(dir)
+	defer j.Close()
+
+	if err := j.Append(&pb.Report{Subject: "a"}); err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+	offset, err := j.Replay(JournalOffset{}, func(*pb.Report) error { return nil })
+	if err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+
+	if err := j.Append(&pb.Report{Subject: "b"}); err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+
+	var got []*pb.Report
+	if _, err := j.Replay(offset, func(r *pb.Report) error {
+		got = append(got, r)
+		return nil
+	}); err != nil {
+		t.Fatalf("Replay() from offset error = %v", err)
+	}
+	if len(got) != 1 || got[0].Subject != "b" {
+		t.Fatalf("Replay() from offset = %+v, want exactly the report appended after the checkpoint", got)
+	}
+}
+
+func TestReportJournalRotatesAndPrunes(t *testing.T) {
+	j, dir := mustNewJournal(t, 0, 1, 0)
+	defer os.RemoveAll(dir)
+	defer j.Close()
+
+	// Force a rotation after every append so maxBackups=1 has something to
+	// prune against.
+	j.maxSizeBytes = 1
+	for i := 0; i < 4; i++ {
+		if err := j.Append(&pb.Report{Subject: "s"}); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+
+	segs, err := j.segments()
+	if err != nil {
+		t.Fatalf("segments() error = %v", err)
+	}
+	// the current (unsealed) segment plus at most maxBackups sealed ones
+	if len(segs) > 2 {
+		t.Errorf("segments() = %v, want at most 2 segments after pruning to maxBackups=1", segs)
+	}
+}
+
+func TestReportJournalReplaySkipsTruncatedTrailingRecord(t *testing.T) {
+	j, dir := mustNewJournal(t, 0, 0, 0)
+	defer os.RemoveAll(dir)
+
+	if err := j.Append(&pb.Report{Subject: "complete"}); err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+	// simulate a crash mid-write: a length prefix promising a payload that
+	// was never fully flushed to disk.
+	var lenbuf [4]byte
+	binary.BigEndian.PutUint32(lenbuf[:], 100)
+	if _, err := j.writer.Write(lenbuf[:]); err != nil {
+		t.Fatalf("failed to write truncated record header: %v", err)
+	}
+	if _, err := j.writer.Write([]byte("short")); err != nil {
+		t.Fatalf("failed to write truncated record payload: %v", err)
+	}
+	if err := j.writer.Flush(); err != nil {
+		t.Fatalf("failed to flush truncated record: %v", err)
+	}
+	j.Close()
+
+	var got []*pb.Report
+	offset, err := j.Replay(JournalOffset{}, func(r *pb.Report) error {
+		got = append(got, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay() error = %v, want the truncated trailing record to be skipped, not fail", err)
+	}
+	if len(got) != 1 || got[0].Subject != "complete" {
+		t.Fatalf("Replay() = %+v, want exactly the one complete record before the truncated tail", got)
+	}
+	if offset.Pos == 0 {
+		t.Fatalf("Replay() offset.Pos = 0, want it to point past the one complete record")
+	}
+
+	// A second replay from the start must behave identically: no error and
+	// the same single "complete" record, since nothing valid has been
+	// appended past the truncated tail yet.
+	var got2 []*pb.Report
+	if _, err := j.Replay(JournalOffset{}, func(r *pb.Report) error {
+		got2 = append(got2, r)
+		return nil
+	}); err != nil {
+		t.Fatalf("second Replay() error = %v", err)
+	}
+	if len(got2) != 1 {
+		t.Fatalf("second Replay() = %+v, want the same single complete record", got2)
+	}
+
+	// Replay must have truncated the torn tail off the segment file, so a
+	// fresh journal reopening it (as a crash-restart would) can Append a
+	// well-formed frame right after the last complete record instead of
+	// writing it after the orphaned bytes.
+	j2, err := NewReportJournal(dir, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("NewReportJournal() reopen error = %v", err)
+	}
+	defer j2.Close()
+	if j2.size != offset.Pos {
+		t.Fatalf("reopened journal size = %d, want %d (the torn tail must have been truncated off)", j2.size, offset.Pos)
+	}
+	if err := j2.Append(&pb.Report{Subject: "after-crash"}); err != nil {
+		t.Fatalf("Append() after reopen error = %v", err)
+	}
+
+	var resumed []*pb.Report
+	if _, err := j2.Replay(offset, func(r *pb.Report) error {
+		resumed = append(resumed, r)
+		return nil
+	}); err != nil {
+		t.Fatalf("Replay() from the truncated offset error = %v", err)
+	}
+	if len(resumed) != 1 || resumed[0].Subject != "after-crash" {
+		t.Fatalf("Replay() from the truncated offset = %+v, want exactly the record appended after the crash", resumed)
+	}
+}
+
+func TestReportJournalResumesFromHighestSegmentOnReopen(t *testing.T) {
+	j, dir := mustNewJournal(t, 0, 0, 0)
+	defer os.RemoveAll(dir)
+	j.maxSizeBytes = 1
+	for i := 0; i < 3; i++ {
+		if err := j.Append(&pb.Report{Subject: "s"}); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+	wantSeq := j.seq
+	j.Close()
+
+	j2, err := NewReportJournal(dir, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("NewReportJournal() reopen error = %v", err)
+	}
+	defer j2.Close()
+	if j2.seq != wantSeq {
+		t.Errorf("reopened journal seq = %d, want %d (the highest existing segment)", j2.seq, wantSeq)
+	}
+}
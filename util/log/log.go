@@ -0,0 +1,115 @@
+// Package log provides the structured logger used by the health service and
+// its callees (store, exchange, decision). It replaces the old du.LogD/LogI/LogE
+// string-formatting helpers with typed, key/value logging on top of zap so
+// that log output can be shipped to ELK/Loki without a text parser.
+package log
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Config controls how a Logger is built. It is embedded in
+// dt.HealthServerConfig so every subsystem shares one encoding/level/output
+// policy unless a subsystem overrides it explicitly.
+type Config struct {
+	// Level is one of "debug", "info", "warn", "error".
+	Level string `json:"level"`
+	// Encoding is either "json" (for ELK/Loki ingestion) or "console" (for
+	// local development).
+	Encoding string `json:"encoding"`
+	// OutputFile is the path log lines are written to. Empty means stderr.
+	OutputFile string `json:"output_file"`
+	// MaxSizeMB, MaxBackups and MaxAgeDays control rotation of OutputFile,
+	// mirroring the filesystem sink used by the report journal.
+	MaxSizeMB  int `json:"max_size_mb"`
+	MaxBackups int `json:"max_backups"`
+	MaxAgeDays int `json:"max_age_days"`
+}
+
+// Logger is the interface every subsystem logs through. It intentionally
+// mirrors the subset of zap.Logger the service needs so call sites stay
+// readable without pulling zap into every file that logs.
+type Logger interface {
+	Debug(msg string, fields ...zap.Field)
+	Info(msg string, fields ...zap.Field)
+	Warn(msg string, fields ...zap.Field)
+	Error(msg string, fields ...zap.Field)
+	// With returns a sub-logger that always includes the given fields, used
+	// to build the per-subsystem loggers (stag, xtag, ...).
+	With(fields ...zap.Field) Logger
+	Sync() error
+}
+
+type zapLogger struct {
+	l *zap.Logger
+}
+
+func (z *zapLogger) Debug(msg string, fields ...zap.Field) { z.l.Debug(msg, fields...) }
+func (z *zapLogger) Info(msg string, fields ...zap.Field)  { z.l.Info(msg, fields...) }
+func (z *zapLogger) Warn(msg string, fields ...zap.Field)  { z.l.Warn(msg, fields...) }
+func (z *zapLogger) Error(msg string, fields ...zap.Field) { z.l.Error(msg, fields...) }
+func (z *zapLogger) With(fields ...zap.Field) Logger       { return &zapLogger{l: z.l.With(fields...)} }
+func (z *zapLogger) Sync() error                           { return z.l.Sync() }
+
+func levelFromString(s string) zapcore.Level {
+	switch s {
+	case "debug":
+		return zapcore.DebugLevel
+	case "warn":
+		return zapcore.WarnLevel
+	case "error":
+		return zapcore.ErrorLevel
+	default:
+		return zapcore.InfoLevel
+	}
+}
+
+// New builds the root Logger for config and tags it with subsystem (e.g.
+// "stag" for service, "xtag" for exchange). Callers typically keep the
+// result around and derive further sub-loggers with With.
+func New(config Config, subsystem string) (Logger, error) {
+	encoderCfg := zap.NewProductionEncoderConfig()
+	encoderCfg.TimeKey = "ts"
+	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	var encoder zapcore.Encoder
+	if config.Encoding == "console" {
+		encoder = zapcore.NewConsoleEncoder(encoderCfg)
+	} else {
+		encoder = zapcore.NewJSONEncoder(encoderCfg)
+	}
+
+	var ws zapcore.WriteSyncer
+	if len(config.OutputFile) > 0 {
+		ws = zapcore.AddSync(&lumberjack.Logger{
+			Filename:   config.OutputFile,
+			MaxSize:    config.MaxSizeMB,
+			MaxBackups: config.MaxBackups,
+			MaxAge:     config.MaxAgeDays,
+		})
+	} else {
+		ws = zapcore.Lock(zapcore.AddSync(zapcore.AddSync(newStderr())))
+	}
+
+	core := zapcore.NewCore(encoder, ws, levelFromString(config.Level))
+	base := zap.New(core).With(zap.String("subsystem", subsystem))
+	return &zapLogger{l: base}, nil
+}
+
+// NewNop returns a Logger that discards everything, used by tests and by
+// code paths that run before a server's Config has been loaded.
+func NewNop() Logger {
+	return &zapLogger{l: zap.NewNop()}
+}
+
+func newStderr() zapcore.WriteSyncer {
+	ws, _, err := zap.Open("stderr")
+	if err != nil {
+		panic(fmt.Sprintf("log: failed to open stderr: %v", err))
+	}
+	return ws
+}
@@ -0,0 +1,35 @@
+package log
+
+import (
+	"fmt"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// oldStyleFormat mimics the allocation pattern of the du.LogD/LogI/LogE
+// helpers it replaces: build the message with fmt.Sprintf, then hand the
+// formatted string to the logger.
+func oldStyleFormat(subject string, handle uint64, err error) string {
+	return fmt.Sprintf("received register request from %s, assigned handle %d, err=%v", subject, handle, err)
+}
+
+func BenchmarkOldStyleFormattedLog(b *testing.B) {
+	l := NewNop()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg := oldStyleFormat("TS_1", uint64(i), nil)
+		l.Debug(msg)
+	}
+}
+
+func BenchmarkStructuredLog(b *testing.B) {
+	l := NewNop()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l.Debug("received register request",
+			zap.String("subject", "TS_1"),
+			zap.Uint64("handle", uint64(i)),
+			zap.Error(nil))
+	}
+}